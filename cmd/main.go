@@ -8,12 +8,22 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
+	"html"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -28,18 +38,63 @@ import (
 
 // RoomState represents the state of a room
 type RoomState struct {
-	PeerConnections []peer.PeerConnectionState
+	PeerConnections []*peer.PeerConnectionState
 	TrackLocals     map[string]*webrtc.TrackLocalStaticRTP
-	TrackNames      map[string]string // trackID -> peer name mapping
-	StreamNames     map[string]string // streamID -> peer name mapping (fallback)
+	TrackNames      map[string]string                      // trackID -> peer name mapping
+	StreamNames     map[string]string                      // streamID -> peer name mapping (fallback)
+	SimulcastLayers map[string]map[string]string           // logical trackID -> rid -> local trackID
+	TrackOwnerIDs   map[string]string                      // trackID -> peer ID mapping, keys roster Publishing
+	ChatHistory     []ChatMessage                          // last maxChatHistory messages, oldest first
 	Lock            sync.RWMutex
 }
 
+// maxChatHistory caps how many chat messages a room replays to a
+// late-joiner.
+const maxChatHistory = 50
+
+// ChatMessage is one in-room text chat message, broadcast to every
+// websocket-signalled peer and replayed to late-joiners from
+// RoomState.ChatHistory.
+type ChatMessage struct {
+	From string `json:"from"`
+	Text string `json:"text"`
+	Ts   int64  `json:"ts"`
+}
+
+// rosterEntry describes one room participant for the "roster" event, sent
+// whenever RoomState.PeerConnections changes.
+type rosterEntry struct {
+	Name       string `json:"name"`
+	PeerID     string `json:"peerID"`
+	Publishing bool   `json:"publishing"`
+}
+
+// multiFlag collects repeated occurrences of a flag (e.g. -turn-url) into a
+// slice instead of keeping only the last one.
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *multiFlag) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
 // nolint
 var (
 	// flag.String(name, value, usage)
 	_addr = flag.String("addr", ":8080", "http service address")
 
+	// ICE stack configuration. _turnURLs is registered with flag.Var in
+	// init() since flag.Var can't be a var-block initializer.
+	_turnURLs   multiFlag
+	_turnUser   = flag.String("turn-user", "", "username for the TURN server(s) given by -turn-url")
+	_turnPass   = flag.String("turn-pass", "", "credential for the TURN server(s) given by -turn-url")
+	_nat1to1IP  = flag.String("nat-1to1-ip", "", "public IP to advertise via ICE NAT 1:1 mapping, for servers behind a static NAT")
+	_iceTCPPort = flag.Int("ice-tcp-port", 0, "if set, listen for ICE TCP candidates on this fixed port instead of only UDP")
+
 	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
@@ -49,15 +104,109 @@ var (
 	roomsLock sync.RWMutex
 	rooms     map[string]*RoomState
 
+	// httpSessions tracks the in-flight WHIP/WHEP sessions so their resource
+	// URL can be DELETEd (teardown) or PATCHed (trickle ICE).
+	httpSessionsLock sync.RWMutex
+	httpSessions     map[string]*httpSession
+
+	// webrtcAPI and iceServers are built from the flags above once main()
+	// parses them; every PeerConnection in the process is created through
+	// webrtcAPI so they all share the same ICE configuration.
+	webrtcAPI  *webrtc.API
+	iceServers []webrtc.ICEServer
+
+	// shuttingDown is set once a shutdown signal is received, so in-flight
+	// and new WHIP/WHEP/websocket handlers can reject new sessions instead
+	// of racing the server's own teardown.
+	shuttingDown atomic.Bool
+
 	log = logging.NewDefaultLoggerFactory().NewLogger("sfu-ws")
 )
 
+// OnRoomCreated and OnRoomDestroyed, if set, are called whenever a room is
+// created or torn down. An operator can assign these (e.g. from an init
+// function) to plug in metrics, recording, or external room registration
+// without forking this file.
+var (
+	OnRoomCreated   func(roomID string)
+	OnRoomDestroyed func(roomID string)
+)
+
+func init() {
+	flag.Var(&_turnURLs, "turn-url", "TURN server URL, may be given multiple times")
+}
+
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// httpSession is a WHIP or WHEP participant's PeerConnection, keyed by its
+// resource ID so later DELETE/PATCH requests can find it again.
+type httpSession struct {
+	peerConnection *webrtc.PeerConnection
+	roomID         string
+}
+
+// newResourceID returns a random hex string suitable for a WHIP/WHEP
+// resource URL.
+func newResourceID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Errorf("Failed to generate resource id: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// buildWebRTCAPI constructs the webrtc.API every PeerConnection in the
+// process is created through, applying whatever ICE-related flags were
+// passed on the command line.
+func buildWebRTCAPI() *webrtc.API {
+	settingEngine := webrtc.SettingEngine{}
+
+	if *_nat1to1IP != "" {
+		settingEngine.SetNAT1To1IPs([]string{*_nat1to1IP}, webrtc.ICECandidateTypeHost)
+	}
+
+	if *_iceTCPPort != 0 {
+		tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: *_iceTCPPort})
+		if err != nil {
+			log.Errorf("Failed to start ICE TCP listener on port %d: %v", *_iceTCPPort, err)
+		} else {
+			settingEngine.SetICETCPMux(webrtc.NewICETCPMux(nil, tcpListener, 8))
+			settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeTCP4, webrtc.NetworkTypeUDP4})
+		}
+	}
+
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
+}
+
+// buildICEServers returns the ICEServers list every PeerConnection is
+// configured with: the default public STUN server, plus a TURN server if
+// -turn-url was given.
+func buildICEServers() []webrtc.ICEServer {
+	iceServers := []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.l.google.com:19302"}},
+	}
+
+	if len(_turnURLs) > 0 {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       _turnURLs,
+			Username:   *_turnUser,
+			Credential: *_turnPass,
+		})
+	}
+
+	return iceServers
+}
+
 func main() {
 	// Parse the flags passed to program
 	flag.Parse()
 
+	webrtcAPI = buildWebRTCAPI()
+	iceServers = buildICEServers()
+
 	// Init rooms map
 	rooms = make(map[string]*RoomState)
+	httpSessions = make(map[string]*httpSession)
 
 	// Read index.html from disk into memory, serve whenever anyone requests /
 	indexHTML, err := os.ReadFile("index.html")
@@ -69,6 +218,15 @@ func main() {
 	// websocket handler
 	http.HandleFunc("/websocket", websocketHandler)
 
+	// WHIP ingest and WHEP playback handlers
+	http.HandleFunc("POST /whip/{roomID}", whipHandler)
+	http.HandleFunc("DELETE /whip/{roomID}/{resourceID}", resourceDeleteHandler)
+	http.HandleFunc("PATCH /whip/{roomID}/{resourceID}", resourcePatchHandler)
+
+	http.HandleFunc("POST /whep/{roomID}", whepHandler)
+	http.HandleFunc("DELETE /whep/{roomID}/{resourceID}", resourceDeleteHandler)
+	http.HandleFunc("PATCH /whep/{roomID}/{resourceID}", resourcePatchHandler)
+
 	// index.html handler
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Determine WebSocket protocol based on environment.
@@ -87,9 +245,56 @@ func main() {
 		}
 	})
 
-	// request a keyframe every 3 seconds for all rooms
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// request a keyframe every 3 seconds for all rooms, until ctx is
+	// cancelled on shutdown
+	go runKeyframeTicker(ctx)
+
+	server := &http.Server{Addr: *_addr} //nolint: gosec
+
+	// On SIGINT/SIGTERM: stop handing out new sessions, tell every peer the
+	// server is going away, close their PeerConnections, then give
+	// in-flight requests up to 10s to finish before the process exits.
+	shutdownComplete := make(chan struct{})
 	go func() {
-		for range time.NewTicker(time.Second * 3).C {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+
+		log.Infof("Shutdown signal received, closing rooms")
+		shuttingDown.Store(true)
+		cancel()
+		shutdownRooms()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer shutdownCancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("Failed to gracefully shut down http server: %v", err)
+		}
+		close(shutdownComplete)
+	}()
+
+	// start HTTP server
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("Failed to start http server: %v", err)
+	}
+
+	<-shutdownComplete
+}
+
+// runKeyframeTicker requests a keyframe every 3 seconds for all rooms,
+// until ctx is cancelled.
+func runKeyframeTicker(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 			roomsLock.RLock()
 			roomList := make([]*RoomState, 0, len(rooms))
 			for _, room := range rooms {
@@ -101,19 +306,45 @@ func main() {
 				// DispatchKeyFrame will lock internally, so we don't need to lock here
 				room.Lock.RLock()
 				peerConnections := room.PeerConnections
+				trackLocals := room.TrackLocals
 				room.Lock.RUnlock()
-				peer.DispatchKeyFrame(&room.Lock, peerConnections)
+				peer.DispatchKeyFrame(&room.Lock, peerConnections, trackLocals)
 			}
 		}
-	}()
+	}
+}
 
-	// start HTTP server
-	if err = http.ListenAndServe(*_addr, nil); err != nil { //nolint: gosec
-		log.Errorf("Failed to start http server: %v", err)
+// shutdownRooms tells every peer in every room that the server is shutting
+// down and closes their PeerConnections, so clients see a clean disconnect
+// instead of a dropped connection.
+func shutdownRooms() {
+	roomsLock.RLock()
+	roomList := make([]*RoomState, 0, len(rooms))
+	for _, room := range rooms {
+		roomList = append(roomList, room)
+	}
+	roomsLock.RUnlock()
+
+	for _, room := range roomList {
+		room.Lock.RLock()
+		peers := room.PeerConnections
+		room.Lock.RUnlock()
+
+		for i := range peers {
+			if peers[i].Websocket != nil {
+				if err := peers[i].Websocket.WriteJSON(&ws.WebsocketMessage{Event: "server_shutdown"}); err != nil {
+					log.Errorf("Failed to notify %s of shutdown: %v", peers[i].Name, err)
+				}
+			}
+			if err := peers[i].PeerConnection.Close(); err != nil {
+				log.Errorf("Failed to close PeerConnection for %s during shutdown: %v", peers[i].Name, err)
+			}
+		}
 	}
 }
 
-// getOrCreateRoom gets an existing room or creates a new one
+// getOrCreateRoom gets an existing room or creates a new one, firing
+// OnRoomCreated the first time a given roomID is seen.
 func getOrCreateRoom(roomID string) *RoomState {
 	roomsLock.Lock()
 	defer roomsLock.Unlock()
@@ -123,12 +354,19 @@ func getOrCreateRoom(roomID string) *RoomState {
 	}
 
 	room := &RoomState{
-		PeerConnections: make([]peer.PeerConnectionState, 0),
+		PeerConnections: make([]*peer.PeerConnectionState, 0),
 		TrackLocals:     make(map[string]*webrtc.TrackLocalStaticRTP),
 		TrackNames:      make(map[string]string),
 		StreamNames:     make(map[string]string),
+		SimulcastLayers: make(map[string]map[string]string),
+		TrackOwnerIDs:   make(map[string]string),
 	}
 	rooms[roomID] = room
+
+	if OnRoomCreated != nil {
+		OnRoomCreated(roomID)
+	}
+
 	return room
 }
 
@@ -143,8 +381,6 @@ func removePeerFromRoom(roomID string, peerConnection *webrtc.PeerConnection) {
 	}
 
 	room.Lock.Lock()
-	defer room.Lock.Unlock()
-
 	for i, pc := range room.PeerConnections {
 		if pc.PeerConnection == peerConnection {
 			room.PeerConnections = append(room.PeerConnections[:i], room.PeerConnections[i+1:]...)
@@ -153,15 +389,127 @@ func removePeerFromRoom(roomID string, peerConnection *webrtc.PeerConnection) {
 	}
 
 	// If room is empty, optionally remove it
-	if len(room.PeerConnections) == 0 && len(room.TrackLocals) == 0 {
+	empty := len(room.PeerConnections) == 0 && len(room.TrackLocals) == 0
+	room.Lock.Unlock()
+
+	if empty {
 		roomsLock.Lock()
 		delete(rooms, roomID)
 		roomsLock.Unlock()
+
+		if OnRoomDestroyed != nil {
+			OnRoomDestroyed(roomID)
+		}
+		return
+	}
+
+	broadcastRoster(room)
+}
+
+// broadcastRoster sends every websocket-signalled peer in the room the
+// current participant list, so clients can render a sidebar without
+// inferring membership from SDP. Call whenever PeerConnections changes.
+func broadcastRoster(room *RoomState) {
+	room.Lock.RLock()
+	// Publishing reflects whether a peer currently has a live track in the
+	// room, not just whether its role allows publishing: a publisher who
+	// hasn't started their camera yet shouldn't show as publishing. Keyed by
+	// peer ID rather than Name, since names aren't unique (e.g. multiple
+	// peers falling back to "Anonymous") and would otherwise mark every
+	// same-named peer as publishing the moment one of them did.
+	publishing := make(map[string]bool, len(room.TrackOwnerIDs))
+	for _, id := range room.TrackOwnerIDs {
+		publishing[id] = true
+	}
+
+	roster := make([]rosterEntry, 0, len(room.PeerConnections))
+	for _, pc := range room.PeerConnections {
+		roster = append(roster, rosterEntry{Name: pc.Name, PeerID: pc.ID, Publishing: publishing[pc.ID]})
+	}
+	peers := room.PeerConnections
+	room.Lock.RUnlock()
+
+	rosterString, err := json.Marshal(roster)
+	if err != nil {
+		log.Errorf("Failed to marshal roster: %v", err)
+		return
+	}
+
+	for i := range peers {
+		if peers[i].Websocket == nil {
+			continue
+		}
+		if err := peers[i].Websocket.WriteJSON(&ws.WebsocketMessage{Event: "roster", Data: string(rosterString)}); err != nil {
+			log.Errorf("Failed to send roster to %s: %v", peers[i].Name, err)
+		}
+	}
+}
+
+// broadcastChat fans msg out to every websocket-signalled peer in the room.
+func broadcastChat(room *RoomState, msg ChatMessage) {
+	msgString, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("Failed to marshal chat message: %v", err)
+		return
+	}
+
+	room.Lock.RLock()
+	peers := room.PeerConnections
+	room.Lock.RUnlock()
+
+	for i := range peers {
+		if peers[i].Websocket == nil {
+			continue
+		}
+		if err := peers[i].Websocket.WriteJSON(&ws.WebsocketMessage{Event: "chat", Data: string(msgString)}); err != nil {
+			log.Errorf("Failed to send chat message to %s: %v", peers[i].Name, err)
+		}
+	}
+}
+
+// tokenBucket is a simple per-connection rate limiter: it holds up to burst
+// tokens, refilled at rate tokens/sec, and reports whether a message may
+// proceed right now.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	rate     float64
+	burst    float64
+	lastFill time.Time
+}
+
+// newTokenBucket returns a tokenBucket starting full, allowing rate
+// messages per second sustained (and a momentary burst up to rate).
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{tokens: rate, rate: rate, burst: rate, lastFill: time.Now()}
+}
+
+// Allow reports whether a message may proceed, consuming one token if so.
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.lastFill).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
 	}
+	b.lastFill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
 }
 
 // Handle incoming websockets.
 func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
+	if shuttingDown.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Upgrade HTTP request to Websocket
 	unsafeConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -217,10 +565,12 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
 		return
 	}
 
-	// Parse join data as JSON: {roomId: "...", name: "..."}
+	// Parse join data as JSON: {roomId: "...", name: "...", role: "publisher"|"subscriber", token: "..."}
 	var joinData struct {
 		RoomID string `json:"roomId"`
 		Name   string `json:"name"`
+		Role   string `json:"role"`
+		Token  string `json:"token"` // reserved for an auth hook; not verified yet
 	}
 	if err := json.Unmarshal([]byte(message.Data), &joinData); err != nil {
 		log.Errorf("Failed to unmarshal join data: %v", err)
@@ -239,16 +589,19 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
 		userName = "Anonymous"
 	}
 
-	log.Infof("Client joining room: %s with name: %s", roomID, userName)
+	// Anyone who doesn't explicitly ask to be a subscriber publishes, same as
+	// before this field existed.
+	canPublish := joinData.Role != "subscriber"
+
+	log.Infof("Client joining room: %s with name: %s, role: %s", roomID, userName, joinData.Role)
 	room = getOrCreateRoom(roomID)
+	peerID := newResourceID()
+	chatLimiter := newTokenBucket(5)
 
 	// Create new PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		}})
+	peerConnection, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{
+		ICEServers: iceServers,
+	})
 	if err != nil {
 		log.Errorf("Failed to creates a PeerConnection: %v", err)
 
@@ -261,25 +614,40 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
 		removePeerFromRoom(roomID, peerConnection)
 	}()
 
-	// Accept one audio  track incoming
-	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio} {
-		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionRecvonly,
-		}); err != nil {
-			log.Errorf("Failed to add transceiver: %v", err)
+	// Accept one audio and one video track incoming, but only from peers
+	// allowed to publish; subscribers get no recvonly transceivers at all.
+	if canPublish {
+		for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+			if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				log.Errorf("Failed to add transceiver: %v", err)
 
-			return
+				return
+			}
 		}
 	}
 
 	// Add our new PeerConnection to room
 	room.Lock.Lock()
-	room.PeerConnections = append(room.PeerConnections, peer.PeerConnectionState{
-		PeerConnection: peerConnection,
-		Websocket:      c,
-		Name:           userName})
+	room.PeerConnections = append(room.PeerConnections, peer.NewPeerConnectionState(peerConnection, c, userName, peerID, canPublish))
+	chatHistory := append([]ChatMessage(nil), room.ChatHistory...)
 	room.Lock.Unlock()
 
+	broadcastRoster(room)
+
+	// Replay recent chat so a late-joiner has context.
+	for _, msg := range chatHistory {
+		msgString, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		if err := c.WriteJSON(&ws.WebsocketMessage{Event: "chat", Data: string(msgString)}); err != nil {
+			log.Errorf("Failed to replay chat history to %s: %v", userName, err)
+			break
+		}
+	}
+
 	// Trickle ICE. Emit server candidate to client
 	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
 		if i == nil {
@@ -304,7 +672,143 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
 		}
 	})
 
-	// If PeerConnection is closed remove it from room
+	wireRoomPeer(peerConnection, room)
+
+	peerConnection.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
+		log.Infof("ICE connection state changed: %s", is)
+	})
+
+	// Signal for the new PeerConnection
+	peer.SignalPeerConnections(&room.Lock, room.TrackLocals, room.SimulcastLayers, room.PeerConnections, room.TrackNames, room.StreamNames)
+
+	// Continue reading messages
+	for {
+		_, raw, err := c.ReadMessage()
+		if err != nil {
+			log.Errorf("Failed to read message: %v", err)
+
+			return
+		}
+
+		log.Infof("Got message: %s", raw)
+
+		if err := json.Unmarshal(raw, &message); err != nil {
+			log.Errorf("Failed to unmarshal json to message: %v", err)
+
+			return
+		}
+
+		switch message.Event {
+		case "candidate":
+			candidate := webrtc.ICECandidateInit{}
+			if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
+				log.Errorf("Failed to unmarshal json to candidate: %v", err)
+
+				return
+			}
+
+			log.Infof("Got candidate: %v", candidate)
+
+			if err := peerConnection.AddICECandidate(candidate); err != nil {
+				log.Errorf("Failed to add ICE candidate: %v", err)
+
+				return
+			}
+		case "answer":
+			answer := webrtc.SessionDescription{}
+			if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
+				log.Errorf("Failed to unmarshal json to answer: %v", err)
+
+				return
+			}
+
+			log.Infof("Got answer: %v", answer)
+
+			if err := peerConnection.SetRemoteDescription(answer); err != nil {
+				log.Errorf("Failed to set remote description: %v", err)
+
+				return
+			}
+		case "setLayer":
+			var layerReq struct {
+				TrackID string `json:"trackID"`
+				RID     string `json:"rid"`
+			}
+			if err := json.Unmarshal([]byte(message.Data), &layerReq); err != nil {
+				log.Errorf("Failed to unmarshal setLayer data: %v", err)
+				return
+			}
+
+			room.Lock.RLock()
+			layers := room.SimulcastLayers[layerReq.TrackID]
+			localTrackID, ok := layers[layerReq.RID]
+			newTrack := room.TrackLocals[localTrackID]
+			// A peer has exactly one sender for this logical track (see
+			// renegotiateOnce), currently carrying whichever layer's local
+			// track ID is in this set; match that exactly rather than by
+			// prefix, since every layer's local track ID shares the same
+			// "<trackID>:" prefix.
+			layerIDs := make(map[string]bool, len(layers))
+			for _, id := range layers {
+				layerIDs[id] = true
+			}
+			room.Lock.RUnlock()
+
+			if !ok || newTrack == nil {
+				log.Errorf("Unknown layer for setLayer request: %+v", layerReq)
+				continue
+			}
+
+			for _, sender := range peerConnection.GetSenders() {
+				if sender.Track() == nil || !layerIDs[sender.Track().ID()] {
+					continue
+				}
+
+				if err := sender.ReplaceTrack(newTrack); err != nil {
+					log.Errorf("Failed to switch layer for setLayer request: %v", err)
+				}
+				break
+			}
+		case "chat":
+			if !chatLimiter.Allow() {
+				log.Errorf("Dropping chat message from %s: rate limit exceeded", userName)
+				continue
+			}
+
+			var chatReq struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal([]byte(message.Data), &chatReq); err != nil {
+				log.Errorf("Failed to unmarshal chat data: %v", err)
+				return
+			}
+
+			chatMsg := ChatMessage{
+				From: userName,
+				// Escape HTML/Markdown-significant characters so a chat
+				// message can't inject markup into other clients' views.
+				Text: html.EscapeString(chatReq.Text),
+				Ts:   time.Now().Unix(),
+			}
+
+			room.Lock.Lock()
+			room.ChatHistory = append(room.ChatHistory, chatMsg)
+			if len(room.ChatHistory) > maxChatHistory {
+				room.ChatHistory = room.ChatHistory[len(room.ChatHistory)-maxChatHistory:]
+			}
+			room.Lock.Unlock()
+
+			broadcastChat(room, chatMsg)
+		default:
+			log.Errorf("unknown message: %+v", message)
+		}
+	}
+}
+
+// wireRoomPeer registers the OnTrack and OnConnectionStateChange handlers
+// that every room participant needs, whether it joined over the websocket or
+// an HTTP (WHIP/WHEP) session.
+func wireRoomPeer(peerConnection *webrtc.PeerConnection, room *RoomState) {
 	peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
 		log.Infof("Connection state change: %s", p)
 
@@ -314,7 +818,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
 				log.Errorf("Failed to close PeerConnection: %v", err)
 			}
 		case webrtc.PeerConnectionStateClosed:
-			peer.SignalPeerConnections(&room.Lock, room.TrackLocals, room.PeerConnections, room.TrackNames, room.StreamNames)
+			peer.SignalPeerConnections(&room.Lock, room.TrackLocals, room.SimulcastLayers, room.PeerConnections, room.TrackNames, room.StreamNames)
 		default:
 		}
 	})
@@ -322,34 +826,49 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
 	peerConnection.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
 		log.Infof("Got remote track: Kind=%s, ID=%s, PayloadType=%d", t.Kind(), t.ID(), t.PayloadType())
 
-		// Find the peer name for this track
+		// Find the peer name and ID for this track
 		var trackOwnerName string
+		var trackOwnerID string
+		var canPublish bool
 		room.Lock.RLock()
 		for _, pc := range room.PeerConnections {
 			if pc.PeerConnection == peerConnection {
 				trackOwnerName = pc.Name
+				trackOwnerID = pc.ID
+				canPublish = pc.CanPublish
 				break
 			}
 		}
 		room.Lock.RUnlock()
 
+		// Subscriber-only peers shouldn't have a recvonly transceiver to send
+		// on in the first place, but reject defensively: pion has no
+		// receiver-level reject, so declining to forward is the closest
+		// equivalent to removing the track.
+		if !canPublish {
+			log.Errorf("Rejecting inbound track from non-publisher peer %s", trackOwnerName)
+			return
+		}
+
 		// Map track ID and stream ID to peer name
 		trackID := t.ID()
 		streamID := t.StreamID()
 		room.Lock.Lock()
 		room.TrackNames[trackID] = trackOwnerName
 		room.StreamNames[streamID] = trackOwnerName
+		room.TrackOwnerIDs[trackID] = trackOwnerID
 		log.Infof("Mapped track ID %s and stream ID %s to peer name: %s", trackID, streamID, trackOwnerName)
 		room.Lock.Unlock()
 
-		// Create a track to fan out our incoming audio to all peers in the room
-		trackLocal := track.AddTrack(t, &room.Lock, room.TrackLocals, room.PeerConnections, room.TrackNames, room.StreamNames)
+		// Create a track to fan out our incoming audio/video to all peers in the room
+		trackLocal := track.AddTrack(t, &room.Lock, room.TrackLocals, room.PeerConnections, room.TrackNames, room.StreamNames, room.SimulcastLayers)
 
 		// Also map the local track ID (in case it's different)
 		localTrackID := trackLocal.ID()
 		if localTrackID != trackID {
 			room.Lock.Lock()
 			room.TrackNames[localTrackID] = trackOwnerName
+			room.TrackOwnerIDs[localTrackID] = trackOwnerID
 			log.Infof("Also mapped local track ID %s to peer name: %s", localTrackID, trackOwnerName)
 			room.Lock.Unlock()
 		}
@@ -358,8 +877,16 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
 			room.Lock.Lock()
 			delete(room.TrackNames, t.ID())
 			delete(room.StreamNames, streamID)
+			delete(room.TrackOwnerIDs, t.ID())
+			delete(room.TrackOwnerIDs, localTrackID)
+			if layers, ok := room.SimulcastLayers[t.ID()]; ok {
+				delete(layers, t.RID())
+				if len(layers) == 0 {
+					delete(room.SimulcastLayers, t.ID())
+				}
+			}
 			room.Lock.Unlock()
-			track.RemoveTrack(trackLocal, &room.Lock, room.TrackLocals, room.PeerConnections, room.TrackNames, room.StreamNames)
+			track.RemoveTrack(trackLocal, &room.Lock, room.TrackLocals, room.SimulcastLayers, room.PeerConnections, room.TrackNames, room.StreamNames)
 		}()
 
 		buf := make([]byte, 1500)
@@ -385,64 +912,270 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) { // nolint
 			}
 		}
 	})
+}
 
-	peerConnection.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
-		log.Infof("ICE connection state changed: %s", is)
+// whipHandler implements the ingest half of WHIP (draft-ietf-wish-whip): a
+// broadcaster POSTs an SDP offer and gets back an SDP answer plus a resource
+// URL it can PATCH (trickle ICE) or DELETE (teardown). The resulting
+// PeerConnection joins the room exactly like a WebSocket publisher, so its
+// tracks are forwarded to every other room member.
+func whipHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	roomID := r.PathValue("roomID")
+	if roomID == "" {
+		http.Error(w, "room id is required", http.StatusBadRequest)
+		return
+	}
+
+	offer, err := readSDPBody(w, r)
+	if err != nil {
+		return
+	}
+
+	room := getOrCreateRoom(roomID)
+
+	peerConnection, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{
+		ICEServers: iceServers,
 	})
+	if err != nil {
+		log.Errorf("Failed to create PeerConnection for WHIP: %v", err)
+		http.Error(w, "failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
 
-	// Signal for the new PeerConnection
-	peer.SignalPeerConnections(&room.Lock, room.TrackLocals, room.PeerConnections, room.TrackNames, room.StreamNames)
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		log.Errorf("Failed to set WHIP remote description: %v", err)
+		http.Error(w, "failed to set remote description", http.StatusBadRequest)
+		return
+	}
 
-	// Continue reading messages
-	for {
-		_, raw, err := c.ReadMessage()
-		if err != nil {
-			log.Errorf("Failed to read message: %v", err)
+	answer, err := createLocalAnswer(peerConnection)
+	if err != nil {
+		log.Errorf("Failed to create WHIP answer: %v", err)
+		http.Error(w, "failed to create answer", http.StatusInternalServerError)
+		return
+	}
 
-			return
-		}
+	resourceID := newResourceID()
 
-		log.Infof("Got message: %s", raw)
+	// Join the room's bookkeeping like any WebSocket publisher would, minus
+	// the websocket itself: this peer signals over HTTP instead.
+	room.Lock.Lock()
+	room.PeerConnections = append(room.PeerConnections, peer.NewPeerConnectionState(peerConnection, nil, "whip-"+roomID, resourceID, true))
+	room.Lock.Unlock()
 
-		if err := json.Unmarshal(raw, &message); err != nil {
-			log.Errorf("Failed to unmarshal json to message: %v", err)
+	wireRoomPeer(peerConnection, room)
+	peer.SignalPeerConnections(&room.Lock, room.TrackLocals, room.SimulcastLayers, room.PeerConnections, room.TrackNames, room.StreamNames)
+	broadcastRoster(room)
 
-			return
-		}
+	httpSessionsLock.Lock()
+	httpSessions[resourceID] = &httpSession{peerConnection: peerConnection, roomID: roomID}
+	httpSessionsLock.Unlock()
 
-		switch message.Event {
-		case "candidate":
-			candidate := webrtc.ICECandidateInit{}
-			if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
-				log.Errorf("Failed to unmarshal json to candidate: %v", err)
+	writeSDPAnswer(w, "/whip/"+roomID+"/"+resourceID, answer)
+}
 
-				return
-			}
+// whepHandler implements WHEP playback: the client POSTs an SDP offer and
+// gets back an SDP answer carrying every track currently published in the
+// room at that moment.
+//
+// A WHEP session's track set is frozen at answer time: unlike websocket
+// peers, it never gets a follow-up offer over PATCH (that endpoint only
+// takes trickle ICE candidates), so tracks published after this request
+// answers never reach it. We can't offer the client anything for a room
+// with no publisher yet, so that case is rejected outright rather than
+// silently answering with no media; a room that already has a publisher but
+// gains another later is a narrower version of the same gap, left open for
+// now.
+func whepHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 
-			log.Infof("Got candidate: %v", candidate)
+	roomID := r.PathValue("roomID")
+	if roomID == "" {
+		http.Error(w, "room id is required", http.StatusBadRequest)
+		return
+	}
 
-			if err := peerConnection.AddICECandidate(candidate); err != nil {
-				log.Errorf("Failed to add ICE candidate: %v", err)
+	offer, err := readSDPBody(w, r)
+	if err != nil {
+		return
+	}
 
-				return
-			}
-		case "answer":
-			answer := webrtc.SessionDescription{}
-			if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
-				log.Errorf("Failed to unmarshal json to answer: %v", err)
+	room := getOrCreateRoom(roomID)
 
-				return
-			}
+	room.Lock.RLock()
+	empty := len(room.TrackLocals) == 0
+	room.Lock.RUnlock()
 
-			log.Infof("Got answer: %v", answer)
+	if empty {
+		http.Error(w, "room has no published tracks yet; retry once a broadcaster connects", http.StatusConflict)
+		return
+	}
 
-			if err := peerConnection.SetRemoteDescription(answer); err != nil {
-				log.Errorf("Failed to set remote description: %v", err)
+	peerConnection, err := webrtcAPI.NewPeerConnection(webrtc.Configuration{
+		ICEServers: iceServers,
+	})
+	if err != nil {
+		log.Errorf("Failed to create PeerConnection for WHEP: %v", err)
+		http.Error(w, "failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
 
-				return
-			}
-		default:
-			log.Errorf("unknown message: %+v", message)
+	// One sender per logical track, same as a websocket subscriber gets from
+	// renegotiateOnce: a WHEP answer never gets a follow-up renegotiation to
+	// fix an over-eager initial track set, so this is the only chance to
+	// collapse a simulcast track's layers down to its default layer instead
+	// of attaching all of them.
+	room.Lock.RLock()
+	for groupKey, trackLocal := range peer.DefaultTrackSet(room.TrackLocals, room.SimulcastLayers) {
+		if _, err := peerConnection.AddTrack(trackLocal); err != nil {
+			log.Errorf("Failed to attach track %s to WHEP peer: %v", groupKey, err)
 		}
 	}
+	room.Lock.RUnlock()
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		log.Errorf("Failed to set WHEP remote description: %v", err)
+		http.Error(w, "failed to set remote description", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := createLocalAnswer(peerConnection)
+	if err != nil {
+		log.Errorf("Failed to create WHEP answer: %v", err)
+		http.Error(w, "failed to create answer", http.StatusInternalServerError)
+		return
+	}
+
+	resourceID := newResourceID()
+
+	room.Lock.Lock()
+	room.PeerConnections = append(room.PeerConnections, peer.NewPeerConnectionState(peerConnection, nil, "whep-"+roomID, resourceID, false))
+	room.Lock.Unlock()
+
+	wireRoomPeer(peerConnection, room)
+	broadcastRoster(room)
+
+	httpSessionsLock.Lock()
+	httpSessions[resourceID] = &httpSession{peerConnection: peerConnection, roomID: roomID}
+	httpSessionsLock.Unlock()
+
+	writeSDPAnswer(w, "/whep/"+roomID+"/"+resourceID, answer)
+}
+
+// resourceDeleteHandler tears down a WHIP or WHEP session: DELETE
+// /whip/{roomID}/{resourceID} or /whep/{roomID}/{resourceID}.
+func resourceDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	resourceID := r.PathValue("resourceID")
+
+	httpSessionsLock.Lock()
+	session, ok := httpSessions[resourceID]
+	delete(httpSessions, resourceID)
+	httpSessionsLock.Unlock()
+
+	if !ok {
+		http.Error(w, "unknown resource", http.StatusNotFound)
+		return
+	}
+
+	if err := session.peerConnection.Close(); err != nil {
+		log.Errorf("Failed to close HTTP session PeerConnection: %v", err)
+	}
+	removePeerFromRoom(session.roomID, session.peerConnection)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// resourcePatchHandler accepts a trickled ICE candidate for a WHIP or WHEP
+// session: PATCH /whip/{roomID}/{resourceID} or /whep/{roomID}/{resourceID}.
+func resourcePatchHandler(w http.ResponseWriter, r *http.Request) {
+	resourceID := r.PathValue("resourceID")
+
+	httpSessionsLock.RLock()
+	session, ok := httpSessions[resourceID]
+	httpSessionsLock.RUnlock()
+
+	if !ok {
+		http.Error(w, "unknown resource", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("Failed to read trickle ICE body: %v", err)
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	candidate := webrtc.ICECandidateInit{}
+	if err := json.Unmarshal(body, &candidate); err != nil {
+		log.Errorf("Failed to unmarshal trickle ICE candidate: %v", err)
+		http.Error(w, "invalid candidate", http.StatusBadRequest)
+		return
+	}
+
+	if err := session.peerConnection.AddICECandidate(candidate); err != nil {
+		log.Errorf("Failed to add trickle ICE candidate: %v", err)
+		http.Error(w, "failed to add candidate", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readSDPBody validates the request carries application/sdp and returns the
+// body as a string, writing an error response itself on failure.
+func readSDPBody(w http.ResponseWriter, r *http.Request) (string, error) {
+	if ct := r.Header.Get("Content-Type"); ct != "application/sdp" {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return "", errUnsupportedMediaType
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// createLocalAnswer creates an SDP answer for peerConnection, sets it as the
+// local description, and waits for ICE gathering to complete so the answer
+// carries every candidate (no trickle on the answer side).
+func createLocalAnswer(peerConnection *webrtc.PeerConnection) (string, error) {
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gatherComplete
+
+	return peerConnection.LocalDescription().SDP, nil
+}
+
+// writeSDPAnswer writes a 201 Created response carrying the SDP answer and
+// the resource URL a client uses for teardown/trickle.
+func writeSDPAnswer(w http.ResponseWriter, location, answer string) {
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(answer))
 }
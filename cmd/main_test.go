@@ -0,0 +1,50 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllowsBurstThenThrottles(t *testing.T) {
+	b := newTokenBucket(10)
+
+	for i := 0; i < 10; i++ {
+		if !b.Allow() {
+			t.Fatalf("expected token %d of initial burst to be allowed", i)
+		}
+	}
+
+	if b.Allow() {
+		t.Fatal("expected bucket to be empty after consuming the initial burst")
+	}
+}
+
+func TestTokenBucketRefillsOverTime(t *testing.T) {
+	b := newTokenBucket(10)
+	for b.Allow() {
+	}
+
+	b.lastFill = b.lastFill.Add(-100 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("expected a refilled token after 100ms at rate 10/s")
+	}
+}
+
+func TestTokenBucketNeverExceedsBurst(t *testing.T) {
+	b := newTokenBucket(5)
+	b.lastFill = b.lastFill.Add(-time.Hour)
+
+	if !b.Allow() {
+		t.Fatal("expected the first token to be allowed after a long idle period")
+	}
+	if b.tokens > b.burst {
+		t.Fatalf("tokens %v exceeded burst %v after a long idle period", b.tokens, b.burst)
+	}
+}
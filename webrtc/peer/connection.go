@@ -3,7 +3,6 @@ package peer
 import (
 	"encoding/json"
 	"sync"
-	"time"
 
 	"github.com/johseongeon/WHIPTube/ws"
 	"github.com/pion/logging"
@@ -13,135 +12,310 @@ import (
 
 var log = logging.NewDefaultLoggerFactory().NewLogger("sfu-ws")
 
-// dispatchKeyFrame sends a keyframe to all PeerConnections, used everytime a new user joins the call.
-func DispatchKeyFrame(listLock *sync.RWMutex, peerConnections []PeerConnectionState) {
+// LocalTrackID returns the ID a remote track is keyed under in a room's
+// trackLocals map. Simulcast layers share a single logical track ID but
+// arrive as distinct TrackRemotes differentiated by RID, so each layer gets
+// its own entry.
+func LocalTrackID(t *webrtc.TrackRemote) string {
+	if t.RID() != "" {
+		return t.ID() + ":" + t.RID()
+	}
+	return t.ID()
+}
+
+// DispatchKeyFrame sends a keyframe request to every PeerConnection's
+// incoming tracks that someone is actually subscribed to, used everytime a
+// new user joins the call. A simulcast layer nobody is watching doesn't get
+// PLI'd, so publishers aren't forced to keep encoding unwatched layers at
+// full keyframe cadence.
+func DispatchKeyFrame(listLock *sync.RWMutex, peerConnections []*PeerConnectionState, trackLocals map[string]*webrtc.TrackLocalStaticRTP) {
 	listLock.Lock()
 	defer listLock.Unlock()
 
+	subscribed := map[string]bool{}
+	for i := range peerConnections {
+		for _, sender := range peerConnections[i].PeerConnection.GetSenders() {
+			if sender.Track() != nil {
+				subscribed[sender.Track().ID()] = true
+			}
+		}
+	}
+
 	for i := range peerConnections {
 		for _, receiver := range peerConnections[i].PeerConnection.GetReceivers() {
-			if receiver.Track() == nil {
+			remoteTrack := receiver.Track()
+			if remoteTrack == nil {
+				continue
+			}
+
+			if _, ok := trackLocals[LocalTrackID(remoteTrack)]; !ok {
+				continue
+			}
+
+			if !subscribed[LocalTrackID(remoteTrack)] {
 				continue
 			}
 
 			_ = peerConnections[i].PeerConnection.WriteRTCP([]rtcp.Packet{
 				&rtcp.PictureLossIndication{
-					MediaSSRC: uint32(receiver.Track().SSRC()),
+					MediaSSRC: uint32(remoteTrack.SSRC()),
 				},
 			})
 		}
 	}
 }
 
-// signalPeerConnections updates each PeerConnection so that it is getting all the expected media tracks.
-func SignalPeerConnections(listLock *sync.RWMutex, trackLocals map[string]*webrtc.TrackLocalStaticRTP, peerConnections []PeerConnectionState, trackNames map[string]string, streamNames map[string]string) { // nolint
-	listLock.Lock()
-	defer func() {
-		listLock.Unlock()
-		DispatchKeyFrame(listLock, peerConnections)
-	}()
-
-	attemptSync := func() (tryAgain bool) {
-		for i := range peerConnections {
-			if peerConnections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
-				peerConnections = append(peerConnections[:i], peerConnections[i+1:]...)
+// simulcastLayerPreference orders the RIDs a subscriber's sender defaults to
+// when a simulcast track first appears, cheapest first. "setLayer" (see
+// cmd/main.go) is what switches it to whatever the client actually wants
+// afterwards.
+var simulcastLayerPreference = []string{"low", "mid", "high"}
 
-				return true // We modified the slice, start from the beginning
+// defaultSimulcastTrack picks the local track a freshly-added sender starts
+// on for a simulcast logical track: the cheapest layer in
+// simulcastLayerPreference that's actually present, or whatever's left if
+// none of the expected RIDs showed up.
+func defaultSimulcastTrack(layers map[string]string, trackLocals map[string]*webrtc.TrackLocalStaticRTP) *webrtc.TrackLocalStaticRTP {
+	for _, rid := range simulcastLayerPreference {
+		if id, ok := layers[rid]; ok {
+			if local, ok := trackLocals[id]; ok {
+				return local
 			}
+		}
+	}
 
-			// map of sender we already are seanding, so we don't double send
-			existingSenders := map[string]bool{}
+	for _, id := range layers {
+		if local, ok := trackLocals[id]; ok {
+			return local
+		}
+	}
 
-			for _, sender := range peerConnections[i].PeerConnection.GetSenders() {
-				if sender.Track() == nil {
-					continue
-				}
+	return nil
+}
 
-				existingSenders[sender.Track().ID()] = true
+// groupOrSelf returns the key a track ID is deduplicated under when deciding
+// whether a peer already has a sender for it: a simulcast layer's logical
+// track ID if layerGroup knows about it, or the track ID itself otherwise.
+// This is what keeps a peer down to one sender per logical track instead of
+// one per simulcast layer.
+func groupOrSelf(trackID string, layerGroup map[string]string) string {
+	if group, ok := layerGroup[trackID]; ok {
+		return group
+	}
+	return trackID
+}
 
-				// If we have a RTPSender that doesn't map to a existing track remove and signal
-				if _, ok := trackLocals[sender.Track().ID()]; !ok {
-					if err := peerConnections[i].PeerConnection.RemoveTrack(sender); err != nil {
+// layerGroupOf builds the reverse of simulcastLayers: a map from a
+// simulcast layer's local track ID to its logical track ID, for use with
+// groupOrSelf.
+func layerGroupOf(simulcastLayers map[string]map[string]string) map[string]string {
+	layerGroup := map[string]string{}
+	for logicalID, layers := range simulcastLayers {
+		for _, id := range layers {
+			layerGroup[id] = logicalID
+		}
+	}
+	return layerGroup
+}
 
-						return true
-					}
-				}
-			}
+// DefaultTrackSet returns the one local track a fresh subscriber sender
+// should start on for every logical track in trackLocals, keyed by logical
+// track ID (or the track's own ID if it isn't simulcast): a plain track
+// maps to itself, a simulcast track maps to its default layer (see
+// defaultSimulcastTrack). renegotiateOnce uses this for websocket peers;
+// WHEP answers use it directly, since a WHEP session never gets a
+// follow-up renegotiation to correct an over-eager initial track set.
+func DefaultTrackSet(trackLocals map[string]*webrtc.TrackLocalStaticRTP, simulcastLayers map[string]map[string]string) map[string]*webrtc.TrackLocalStaticRTP {
+	layerGroup := layerGroupOf(simulcastLayers)
 
-			// Don't receive videos we are sending, make sure we don't have loopback
-			for _, receiver := range peerConnections[i].PeerConnection.GetReceivers() {
-				if receiver.Track() == nil {
-					continue
-				}
+	defaultByGroup := map[string]*webrtc.TrackLocalStaticRTP{}
+	for logicalID, layers := range simulcastLayers {
+		defaultByGroup[logicalID] = defaultSimulcastTrack(layers, trackLocals)
+	}
 
-				existingSenders[receiver.Track().ID()] = true
+	set := map[string]*webrtc.TrackLocalStaticRTP{}
+	for trackID, local := range trackLocals {
+		groupKey := groupOrSelf(trackID, layerGroup)
+		if groupKey != trackID {
+			if def := defaultByGroup[groupKey]; def == nil || def.ID() != trackID {
+				continue
 			}
+		}
+		set[groupKey] = local
+	}
+	return set
+}
 
-			// Add all track we aren't sending yet to the PeerConnection
-			for trackID := range trackLocals {
-				if _, ok := existingSenders[trackID]; !ok {
-					if _, err := peerConnections[i].PeerConnection.AddTrack(trackLocals[trackID]); err != nil {
-						log.Errorf("Failed to add track to PeerConnection: %v", err)
-						return true
-					}
-				}
-			}
+// SignalPeerConnections tells every peer in the room that something about
+// its expected tracks may have changed. It only posts a coalesced wake-up per
+// peer (see PeerConnectionState.Notify) and returns immediately; the actual
+// CreateOffer/SetLocalDescription/websocket round-trip for a given peer runs
+// on its own goroutine under that peer's HandshakeLock, so one slow
+// websocket can't block renegotiation for the rest of the room, and repeated
+// calls (e.g. one per track added) coalesce into a single re-sync per peer
+// instead of racing or queuing up retries.
+func SignalPeerConnections(listLock *sync.RWMutex, trackLocals map[string]*webrtc.TrackLocalStaticRTP, simulcastLayers map[string]map[string]string, peerConnections []*PeerConnectionState, trackNames map[string]string, streamNames map[string]string) { // nolint
+	listLock.RLock()
+	defer listLock.RUnlock()
 
-			offer, err := peerConnections[i].PeerConnection.CreateOffer(nil)
-			if err != nil {
-				log.Errorf("Failed to create offer: %v", err)
-				return true
-			}
+	for i := range peerConnections {
+		if peerConnections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			continue
+		}
 
-			if err = peerConnections[i].PeerConnection.SetLocalDescription(offer); err != nil {
-				log.Errorf("Failed to set local description: %v", err)
-				return true
-			}
+		// HTTP (WHIP/WHEP) sessions signal over their own request/response
+		// and PATCH trickle, not this websocket-based renegotiation loop.
+		if peerConnections[i].Websocket == nil {
+			continue
+		}
 
-			offerString, err := json.Marshal(offer)
-			if err != nil {
-				log.Errorf("Failed to marshal offer to json: %v", err)
-				return true
-			}
+		ps := peerConnections[i]
+		ps.Notify()
+		go renegotiatePeer(ps, listLock, trackLocals, simulcastLayers, trackNames, streamNames)
+	}
 
-			// Create offer message with track names and stream names
-			offerData := map[string]interface{}{
-				"offer":       json.RawMessage(offerString),
-				"trackNames":  trackNames,
-				"streamNames": streamNames,
-			}
-			offerDataString, err := json.Marshal(offerData)
-			if err != nil {
-				log.Errorf("Failed to marshal offer data: %v", err)
-				return true
+	go DispatchKeyFrame(listLock, peerConnections, trackLocals)
+}
+
+// renegotiatePeer is spawned once per SignalPeerConnections call for every
+// still-open, websocket-signalled peer. Whichever goroutine wins ps's
+// HandshakeLock drains ps.RenegotiateCh (and anything queued up behind
+// markPendingSync while it was working) until there's nothing left to do;
+// every other goroutine for the same peer just leaves its wake-up queued and
+// returns, trusting the winner to pick it up.
+func renegotiatePeer(ps *PeerConnectionState, listLock *sync.RWMutex, trackLocals map[string]*webrtc.TrackLocalStaticRTP, simulcastLayers map[string]map[string]string, trackNames map[string]string, streamNames map[string]string) {
+	if !ps.HandshakeLock.TryLock() {
+		ps.markPendingSync()
+		return
+	}
+
+	for {
+		select {
+		case <-ps.RenegotiateCh:
+		default:
+			ps.HandshakeLock.Unlock()
+			// A wake-up posted between the check above and Unlock found the
+			// lock still held and was left queued; take the lock back and
+			// drain it unless another goroutine already has.
+			if len(ps.RenegotiateCh) == 0 || !ps.HandshakeLock.TryLock() {
+				return
 			}
+			continue
+		}
+
+		if ps.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			ps.HandshakeLock.Unlock()
+			return
+		}
 
-			log.Errorf("Send offer to client with trackNames: %v", trackNames)
+		if err := renegotiateOnce(ps, listLock, trackLocals, simulcastLayers, trackNames, streamNames); err != nil {
+			ps.HandshakeLock.Unlock()
+			return
+		}
+
+		if ps.takePendingSync() {
+			ps.Notify()
+		}
+	}
+}
+
+// renegotiateOnce brings ps's senders in line with trackLocals and sends it
+// a fresh offer carrying the current trackNames/streamNames. A peer gets at
+// most one sender per logical track: a simulcast track's layers share a
+// sender that starts on defaultSimulcastTrack's pick and is only ever moved
+// between layers by "setLayer", never duplicated into one sender per layer.
+func renegotiateOnce(ps *PeerConnectionState, listLock *sync.RWMutex, trackLocals map[string]*webrtc.TrackLocalStaticRTP, simulcastLayers map[string]map[string]string, trackNames map[string]string, streamNames map[string]string) error {
+	listLock.RLock()
+	defer listLock.RUnlock()
+
+	layerGroup := layerGroupOf(simulcastLayers)
 
-			if err = peerConnections[i].Websocket.WriteJSON(&ws.WebsocketMessage{
-				Event: "offer",
-				Data:  string(offerDataString),
-			}); err != nil {
-				return true
+	// map of sender we already are seanding, so we don't double send
+	existingSenders := map[string]bool{}
+
+	for _, sender := range ps.PeerConnection.GetSenders() {
+		if sender.Track() == nil {
+			continue
+		}
+
+		existingSenders[groupOrSelf(sender.Track().ID(), layerGroup)] = true
+
+		// If we have a RTPSender that doesn't map to a existing track remove and signal
+		if _, ok := trackLocals[sender.Track().ID()]; !ok {
+			if err := ps.PeerConnection.RemoveTrack(sender); err != nil {
+				return err
 			}
 		}
+	}
+
+	// Don't receive videos we are sending, make sure we don't have loopback
+	for _, receiver := range ps.PeerConnection.GetReceivers() {
+		if receiver.Track() == nil {
+			continue
+		}
 
-		return tryAgain
+		existingSenders[groupOrSelf(LocalTrackID(receiver.Track()), layerGroup)] = true
 	}
 
-	for syncAttempt := 0; ; syncAttempt++ {
-		if syncAttempt == 25 {
-			// Release the lock and attempt a sync in 3 seconds. We might be blocking a RemoveTrack or AddTrack
-			go func() {
-				time.Sleep(time.Second * 3)
-				SignalPeerConnections(listLock, trackLocals, peerConnections, trackNames, streamNames)
-			}()
+	// Add one sender per logical track we aren't sending yet: a plain track
+	// adds itself, a simulcast track adds only its default layer (the rest
+	// are reachable later via "setLayer", not sent up front).
+	for groupKey, local := range DefaultTrackSet(trackLocals, simulcastLayers) {
+		if existingSenders[groupKey] {
+			continue
+		}
 
-			return
+		if ps.CanPublish {
+			if _, err := ps.PeerConnection.AddTrack(local); err != nil {
+				log.Errorf("Failed to add track to PeerConnection: %v", err)
+				return err
+			}
+			continue
 		}
 
-		if !attemptSync() {
-			break
+		// Subscriber-only peers never publish back, so give them an explicit
+		// sendonly transceiver instead of the sendrecv one AddTrack would pick.
+		if _, err := ps.PeerConnection.AddTransceiverFromTrack(local, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		}); err != nil {
+			log.Errorf("Failed to add track to subscriber PeerConnection: %v", err)
+			return err
 		}
 	}
+
+	offer, err := ps.PeerConnection.CreateOffer(nil)
+	if err != nil {
+		log.Errorf("Failed to create offer: %v", err)
+		return err
+	}
+
+	if err = ps.PeerConnection.SetLocalDescription(offer); err != nil {
+		log.Errorf("Failed to set local description: %v", err)
+		return err
+	}
+
+	offerString, err := json.Marshal(offer)
+	if err != nil {
+		log.Errorf("Failed to marshal offer to json: %v", err)
+		return err
+	}
+
+	// Create offer message with track names and stream names
+	offerData := map[string]interface{}{
+		"offer":       json.RawMessage(offerString),
+		"trackNames":  trackNames,
+		"streamNames": streamNames,
+	}
+	offerDataString, err := json.Marshal(offerData)
+	if err != nil {
+		log.Errorf("Failed to marshal offer data: %v", err)
+		return err
+	}
+
+	log.Errorf("Send offer to client with trackNames: %v", trackNames)
+
+	return ps.Websocket.WriteJSON(&ws.WebsocketMessage{
+		Event: "offer",
+		Data:  string(offerDataString),
+	})
 }
@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestGroupOrSelf(t *testing.T) {
+	layerGroup := map[string]string{
+		"track1:low":  "track1",
+		"track1:high": "track1",
+	}
+
+	if got := groupOrSelf("track1:low", layerGroup); got != "track1" {
+		t.Errorf("groupOrSelf(%q) = %q, want %q", "track1:low", got, "track1")
+	}
+
+	if got := groupOrSelf("track2", layerGroup); got != "track2" {
+		t.Errorf("groupOrSelf(%q) = %q, want %q", "track2", got, "track2")
+	}
+}
+
+func newTestTrackLocal(t *testing.T, id string) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	local, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, id, "stream")
+	if err != nil {
+		t.Fatalf("failed to create track local %q: %v", id, err)
+	}
+	return local
+}
+
+func TestDefaultSimulcastTrackPrefersCheapestPresentLayer(t *testing.T) {
+	trackLocals := map[string]*webrtc.TrackLocalStaticRTP{
+		"track1:mid":  newTestTrackLocal(t, "track1:mid"),
+		"track1:high": newTestTrackLocal(t, "track1:high"),
+	}
+	layers := map[string]string{
+		"mid":  "track1:mid",
+		"high": "track1:high",
+	}
+
+	got := defaultSimulcastTrack(layers, trackLocals)
+	if got == nil || got.ID() != "track1:mid" {
+		t.Errorf("defaultSimulcastTrack() = %v, want track1:mid (mid beats high in simulcastLayerPreference)", got)
+	}
+}
+
+func TestDefaultSimulcastTrackFallsBackWhenPreferredRIDsMissing(t *testing.T) {
+	trackLocals := map[string]*webrtc.TrackLocalStaticRTP{
+		"track1:custom": newTestTrackLocal(t, "track1:custom"),
+	}
+	layers := map[string]string{
+		"custom": "track1:custom",
+	}
+
+	got := defaultSimulcastTrack(layers, trackLocals)
+	if got == nil || got.ID() != "track1:custom" {
+		t.Errorf("defaultSimulcastTrack() = %v, want track1:custom", got)
+	}
+}
+
+func TestDefaultSimulcastTrackReturnsNilWhenNoLayerResolves(t *testing.T) {
+	trackLocals := map[string]*webrtc.TrackLocalStaticRTP{}
+	layers := map[string]string{
+		"low": "track1:low",
+	}
+
+	if got := defaultSimulcastTrack(layers, trackLocals); got != nil {
+		t.Errorf("defaultSimulcastTrack() = %v, want nil", got)
+	}
+}
@@ -0,0 +1,89 @@
+package peer
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/johseongeon/WHIPTube/ws"
+	"github.com/pion/webrtc/v4"
+)
+
+// PeerConnectionState tracks a single room participant's PeerConnection
+// together with the websocket used to signal it. Websocket is nil for
+// participants that joined over an HTTP session (WHIP/WHEP) instead of the
+// websocket signalling path; SignalPeerConnections skips those when it
+// fans out renegotiation.
+type PeerConnectionState struct {
+	PeerConnection *webrtc.PeerConnection
+	Websocket      *ws.ThreadSafeWriter
+	Name           string
+
+	// ID uniquely identifies this peer within the room, independent of Name
+	// (which participants may share). Used as the roster's peerID.
+	ID string
+
+	// CanPublish reports whether this peer is allowed to send media into the
+	// room. Subscriber-only peers get no recvonly transceivers at join time
+	// and have any inbound track rejected as a defensive backstop.
+	CanPublish bool
+
+	// HandshakeLock serializes this peer's own offer/answer renegotiation so
+	// two concurrent track changes can't race to CreateOffer/SetLocalDescription
+	// on the same PeerConnection. It's a pointer (rather than an embedded
+	// sync.Mutex), and RenegotiateCh/pendingSync likewise reference types, for
+	// the same reason RoomState.PeerConnections holds *PeerConnectionState:
+	// renegotiatePeer's goroutine captures one of these and must keep acting
+	// on the exact same peer even after the room's slice is later shifted by
+	// a departure.
+	HandshakeLock *sync.Mutex
+
+	// RenegotiateCh carries a coalesced wake-up whenever this peer's tracks
+	// changed. It's buffered to size 1 so Notify never blocks the caller
+	// (typically the RTP read loop in OnTrack/RemoveTrack): a pending wake-up
+	// that hasn't been drained yet is enough, a second one adds nothing.
+	RenegotiateCh chan struct{}
+
+	// pendingSync is set when a track changes while this peer is already
+	// mid-handshake; once that handshake completes it's checked and, if set,
+	// one more round runs for this peer alone rather than dropping the update.
+	pendingSync *atomic.Bool
+}
+
+// NewPeerConnectionState builds a PeerConnectionState with its signalling
+// primitives initialised and ready to use. It returns a pointer, not a
+// value, so the room's PeerConnections slice can be reordered (e.g. when a
+// peer departs) without invalidating a pointer some other goroutine is
+// still holding onto.
+func NewPeerConnectionState(pc *webrtc.PeerConnection, socket *ws.ThreadSafeWriter, name, id string, canPublish bool) *PeerConnectionState {
+	return &PeerConnectionState{
+		PeerConnection: pc,
+		Websocket:      socket,
+		Name:           name,
+		ID:             id,
+		CanPublish:     canPublish,
+		HandshakeLock:  &sync.Mutex{},
+		RenegotiateCh:  make(chan struct{}, 1),
+		pendingSync:    &atomic.Bool{},
+	}
+}
+
+// Notify posts a coalesced wake-up on RenegotiateCh; if one is already queued
+// this is a no-op.
+func (p *PeerConnectionState) Notify() {
+	select {
+	case p.RenegotiateCh <- struct{}{}:
+	default:
+	}
+}
+
+// markPendingSync records that this peer's tracks changed again while it was
+// already being renegotiated.
+func (p *PeerConnectionState) markPendingSync() {
+	p.pendingSync.Store(true)
+}
+
+// takePendingSync reports whether the peer was marked pending and clears the
+// mark.
+func (p *PeerConnectionState) takePendingSync() bool {
+	return p.pendingSync.Swap(false)
+}
@@ -0,0 +1,59 @@
+// Package track manages the TrackLocalStaticRTP fan-out tracks that back
+// every publisher in a room.
+package track
+
+import (
+	"sync"
+
+	"github.com/johseongeon/WHIPTube/webrtc/peer"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v4"
+)
+
+var log = logging.NewDefaultLoggerFactory().NewLogger("sfu-ws")
+
+// AddTrack creates a local track to fan out t to the rest of the room,
+// registers it in trackLocals, and re-signals every peer so it gets added.
+//
+// When t carries a simulcast RID, its local track is keyed separately per
+// RID (via peer.LocalTrackID) and recorded in simulcastLayers under t.ID()
+// so the room can later look up "the 'low' layer of track X" and, for
+// example, switch a subscriber's sender to it.
+func AddTrack(t *webrtc.TrackRemote, listLock *sync.RWMutex, trackLocals map[string]*webrtc.TrackLocalStaticRTP, peerConnections []*peer.PeerConnectionState, trackNames map[string]string, streamNames map[string]string, simulcastLayers map[string]map[string]string) *webrtc.TrackLocalStaticRTP {
+	listLock.Lock()
+	defer func() {
+		listLock.Unlock()
+		peer.SignalPeerConnections(listLock, trackLocals, simulcastLayers, peerConnections, trackNames, streamNames)
+	}()
+
+	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, peer.LocalTrackID(t), t.StreamID())
+	if err != nil {
+		log.Errorf("Failed to create TrackLocalStaticRTP: %v", err)
+		return nil
+	}
+
+	trackLocals[trackLocal.ID()] = trackLocal
+
+	if rid := t.RID(); rid != "" {
+		layers, ok := simulcastLayers[t.ID()]
+		if !ok {
+			layers = map[string]string{}
+			simulcastLayers[t.ID()] = layers
+		}
+		layers[rid] = trackLocal.ID()
+	}
+
+	return trackLocal
+}
+
+// RemoveTrack drops trackLocal from trackLocals and re-signals every peer so
+// it gets removed.
+func RemoveTrack(trackLocal *webrtc.TrackLocalStaticRTP, listLock *sync.RWMutex, trackLocals map[string]*webrtc.TrackLocalStaticRTP, simulcastLayers map[string]map[string]string, peerConnections []*peer.PeerConnectionState, trackNames map[string]string, streamNames map[string]string) {
+	listLock.Lock()
+	defer func() {
+		listLock.Unlock()
+		peer.SignalPeerConnections(listLock, trackLocals, simulcastLayers, peerConnections, trackNames, streamNames)
+	}()
+
+	delete(trackLocals, trackLocal.ID())
+}